@@ -5,10 +5,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,6 +21,20 @@ const (
 	MAX_INCR_ID_BIT         = 50
 )
 
+// FsyncPolicy controls how aggressively TopicCommitLogMgr fsyncs the active
+// segment after appends.
+type FsyncPolicy int
+
+const (
+	// FsyncEveryAppend fsyncs after every single appended record (safest,
+	// slowest). This is the default.
+	FsyncEveryAppend FsyncPolicy = iota
+	// FsyncEveryNAppends fsyncs once every N appended records.
+	FsyncEveryNAppends
+	// FsyncInterval fsyncs at most once per FsyncEvery duration.
+	FsyncInterval
+)
+
 var (
 	ErrCommitLogWrongID         = errors.New("commit log id is wrong")
 	ErrCommitLogIDNotFound      = errors.New("commit log id is not found")
@@ -23,6 +42,7 @@ var (
 	ErrCommitLogEOF             = errors.New("commit log end of file")
 	ErrCommitLogOffsetInvalid   = errors.New("commit log offset is invalid")
 	ErrCommitLogPartitionExceed = errors.New("commit log partition id is exceeded")
+	ErrCommitLogCorrupt         = errors.New("commit log record failed checksum verification")
 )
 
 type CommitLogData struct {
@@ -50,15 +70,45 @@ func GetNextLogOffset(cur int64) int64 {
 	return cur + int64(GetLogDataSize())
 }
 
+// TopicCommitLogMgr stores the commit log for a topic partition as a
+// directory of segments (à la Kafka): a sequence of immutable `.log`
+// segments, each capped at MaxSegmentBytes and paired with a sparse
+// `.index` file, plus one active (last) segment that is still being
+// appended to. Segments are named after the logID of their first record,
+// except the very first segment (and one migrated from the old single-file
+// layout), which is named 0.
+//
+// Each record is framed as [magic][flags][len:varint][payload][crc32c] so
+// records can be variable length (e.g. snappy-compressed) and readers find
+// the next record from the frame header rather than by a fixed stride.
+// Segments written before framing was introduced are read in a
+// compatibility mode (CommitLogData marshaled back-to-back at a fixed
+// stride) but are never appended to again: the first append after loading
+// such a segment rolls over to a fresh, framed one. GetNextLogOffset and
+// GetPrevLogOffset only make sense for that legacy fixed-stride format.
 type TopicCommitLogMgr struct {
 	topic         string
 	partition     int
 	nLogID        int64
 	pLogID        int64
-	path          string
+	segDir        string
+	segments      []*commitLogSegment
+	maxSegBytes   int64
+	indexEveryN   int64
+	compression   Compression
 	committedLogs []CommitLogData
-	appender      *os.File
+	condensor     *condensor
+
+	fsyncPolicy       FsyncPolicy
+	fsyncEveryN       int64
+	fsyncEvery        time.Duration
+	appendsSinceFsync int64
+	lastFsyncTime     time.Time
 	sync.Mutex
+	// cond is broadcast whenever AppendCommitLog commits a new record, so a
+	// CommitLogReader in Follow mode can block on it instead of polling
+	// GetLastLogOffset.
+	cond *sync.Cond
 }
 
 func GetTopicPartitionLogPath(basepath, t string, p int) string {
@@ -67,40 +117,56 @@ func GetTopicPartitionLogPath(basepath, t string, p int) string {
 }
 
 func InitTopicCommitLogMgr(t string, p int, basepath string, commitBufSize int) (*TopicCommitLogMgr, error) {
+	return InitTopicCommitLogMgrWithCompression(t, p, basepath, commitBufSize, CompressionNone)
+}
+
+// InitTopicCommitLogMgrWithCompression is like InitTopicCommitLogMgr but
+// lets the caller choose the Compression applied to newly written records.
+// Existing records (legacy fixed-stride or previously framed with a
+// different setting) keep whatever format/compression they were written
+// with and are decompressed transparently on read.
+func InitTopicCommitLogMgrWithCompression(t string, p int, basepath string, commitBufSize int, compression Compression) (*TopicCommitLogMgr, error) {
 	if uint64(p) >= uint64(1)<<(63-MAX_INCR_ID_BIT) {
 		return nil, ErrCommitLogPartitionExceed
 	}
-	fullpath := GetTopicPartitionLogPath(basepath, t, p)
+	segDir := GetTopicPartitionLogPath(basepath, t, p)
+	if err := migrateLegacyCommitLogIfNeeded(segDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(segDir, 0755); err != nil {
+		return nil, err
+	}
 	mgr := &TopicCommitLogMgr{
 		topic:         t,
 		partition:     p,
 		nLogID:        0,
 		pLogID:        0,
-		path:          fullpath,
+		segDir:        segDir,
+		maxSegBytes:   DEFAULT_SEGMENT_MAX_BYTES,
+		indexEveryN:   DEFAULT_SEGMENT_INDEX_INTERVAL,
+		compression:   compression,
 		committedLogs: make([]CommitLogData, 0, commitBufSize),
+		fsyncPolicy:   FsyncEveryAppend,
 	}
-	// load check point index. read sizeof(CommitLogData) until EOF.
-	var err error
-	// note: using append mode can make sure write only to end of file
-	// we can do random read without affecting the append behavior
-	mgr.appender, err = os.OpenFile(mgr.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		coordLog.Infof("open topic commit log file error: %v", err)
+	mgr.cond = sync.NewCond(mgr)
+	if err := mgr.loadSegments(); err != nil {
 		return nil, err
 	}
-
-	//load meta
-	f, err := mgr.appender.Stat()
-	if err != nil {
-		coordLog.Infof("stat file error: %v", err)
+	if discarded, err := mgr.activeSegment().recoverTornWrite(); err != nil {
 		return nil, err
+	} else if discarded > 0 {
+		coordLog.Infof("commit log for topic %s partition %d recovered from a torn write, discarded %d trailing bytes",
+			t, p, discarded)
 	}
-	fsize := f.Size()
+
 	// read latest logid and incr. combine the partition id at high.
-	if fsize > 0 {
-		num := fsize / int64(GetLogDataSize())
-		roundOffset := (num - 1) * int64(GetLogDataSize())
-		l, err := mgr.GetCommitLogFromOffset(roundOffset)
+	if mgr.totalSizeNoLock() > 0 {
+		prevOffset, err := mgr.prevRecordOffsetNoLock(mgr.totalSizeNoLock())
+		if err != nil {
+			coordLog.Infof("load file error: %v", err)
+			return nil, err
+		}
+		l, err := mgr.getCommitLogFromOffsetNoLock(prevOffset)
 		if err != nil {
 			coordLog.Infof("load file error: %v", err)
 			return nil, err
@@ -113,11 +179,172 @@ func InitTopicCommitLogMgr(t string, p int, basepath string, commitBufSize int)
 	return mgr, nil
 }
 
+// InitTopicCommitLogMgrWithMaintenance is like
+// InitTopicCommitLogMgrWithCompression but also starts the background
+// condensor, so the commit log is periodically rewritten into a compact
+// form once it grows past maxUncondensedBytes. Pass maintenanceInterval<=0
+// to use DEFAULT_CONDENSE_MAINTENANCE_INTERVAL.
+func InitTopicCommitLogMgrWithMaintenance(t string, p int, basepath string, commitBufSize int,
+	compression Compression, maintenanceInterval time.Duration, maxUncondensedBytes int64) (*TopicCommitLogMgr, error) {
+	mgr, err := InitTopicCommitLogMgrWithCompression(t, p, basepath, commitBufSize, compression)
+	if err != nil {
+		return nil, err
+	}
+	mgr.StartCondensing(maintenanceInterval, maxUncondensedBytes)
+	return mgr, nil
+}
+
+// SetMaxSegmentBytes overrides the default segment rollover threshold. It
+// should be called right after InitTopicCommitLogMgr, before any append.
+func (self *TopicCommitLogMgr) SetMaxSegmentBytes(n int64) {
+	self.Lock()
+	self.maxSegBytes = n
+	self.Unlock()
+}
+
+// SetFsyncPolicy configures how often the active segment is fsynced after
+// an append. n is only used by FsyncEveryNAppends, every by FsyncInterval.
+func (self *TopicCommitLogMgr) SetFsyncPolicy(policy FsyncPolicy, n int64, every time.Duration) {
+	self.Lock()
+	self.fsyncPolicy = policy
+	self.fsyncEveryN = n
+	self.fsyncEvery = every
+	self.Unlock()
+}
+
+// maybeSyncNoLock applies the configured fsync policy after an append to
+// the active segment.
+func (self *TopicCommitLogMgr) maybeSyncNoLock(active *commitLogSegment) error {
+	self.appendsSinceFsync++
+	switch self.fsyncPolicy {
+	case FsyncEveryAppend:
+		self.appendsSinceFsync = 0
+		return active.Sync()
+	case FsyncEveryNAppends:
+		if self.fsyncEveryN <= 0 || self.appendsSinceFsync >= self.fsyncEveryN {
+			self.appendsSinceFsync = 0
+			return active.Sync()
+		}
+	case FsyncInterval:
+		if self.fsyncEvery <= 0 || time.Since(self.lastFsyncTime) >= self.fsyncEvery {
+			self.appendsSinceFsync = 0
+			self.lastFsyncTime = time.Now()
+			return active.Sync()
+		}
+	}
+	return nil
+}
+
+// loadSegments discovers existing *.log segment files under segDir (sorted
+// by baseID), opens them and rebuilds their cumulative baseOffset, creating
+// a first empty segment if the directory is empty.
+func (self *TopicCommitLogMgr) loadSegments() error {
+	entries, err := ioutil.ReadDir(self.segDir)
+	if err != nil {
+		return err
+	}
+	var baseIDs []int64
+	for _, fi := range entries {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != segmentFileSuffix {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), segmentFileSuffix)
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		baseIDs = append(baseIDs, id)
+	}
+	sort.Slice(baseIDs, func(i, j int) bool { return baseIDs[i] < baseIDs[j] })
+	var offset int64
+	for _, id := range baseIDs {
+		seg, err := openOrCreateSegment(self.segDir, id, offset, self.indexEveryN)
+		if err != nil {
+			return err
+		}
+		self.segments = append(self.segments, seg)
+		offset += seg.size
+	}
+	if len(self.segments) == 0 {
+		seg, err := openOrCreateSegment(self.segDir, 0, 0, self.indexEveryN)
+		if err != nil {
+			return err
+		}
+		self.segments = append(self.segments, seg)
+	}
+	return nil
+}
+
+func (self *TopicCommitLogMgr) totalSizeNoLock() int64 {
+	last := self.segments[len(self.segments)-1]
+	return last.baseOffset + last.size
+}
+
+func (self *TopicCommitLogMgr) activeSegment() *commitLogSegment {
+	return self.segments[len(self.segments)-1]
+}
+
+// segmentForOffset returns the segment containing the given cumulative
+// offset, found by binary-searching segment base offsets.
+func (self *TopicCommitLogMgr) segmentForOffset(offset int64) (*commitLogSegment, error) {
+	if len(self.segments) == 0 {
+		return nil, ErrCommitLogOutofBound
+	}
+	i := sort.Search(len(self.segments), func(i int) bool {
+		return self.segments[i].baseOffset > offset
+	})
+	if i == 0 {
+		return nil, ErrCommitLogOutofBound
+	}
+	return self.segments[i-1], nil
+}
+
+// segmentForLogID returns the segment that should contain logID, found by
+// binary-searching segment base logIDs.
+func (self *TopicCommitLogMgr) segmentForLogID(logID int64) *commitLogSegment {
+	i := sort.Search(len(self.segments), func(i int) bool {
+		return self.segments[i].baseID > logID
+	})
+	if i == 0 {
+		return self.segments[0]
+	}
+	return self.segments[i-1]
+}
+
+// prevRecordOffsetNoLock returns the global start offset of the record
+// immediately preceding the given global offset (which must itself land on
+// a record boundary, typically EOF or a prior return value of this
+// manager). It walks segments back-to-front using each segment's cached
+// record-boundary list, since with variable-length framed records the
+// previous boundary can no longer be computed by subtracting a fixed
+// stride.
+func (self *TopicCommitLogMgr) prevRecordOffsetNoLock(boundary int64) (int64, error) {
+	for i := len(self.segments) - 1; i >= 0; i-- {
+		seg := self.segments[i]
+		if seg.baseOffset >= boundary {
+			continue
+		}
+		if err := seg.ensureRecordOffsets(); err != nil {
+			return 0, err
+		}
+		for j := len(seg.recordOffsets) - 1; j >= 0; j-- {
+			global := seg.baseOffset + seg.recordOffsets[j]
+			if global < boundary {
+				return global, nil
+			}
+		}
+	}
+	return 0, ErrCommitLogIDNotFound
+}
+
 func (self *TopicCommitLogMgr) Close() {
+	self.StopCondensing()
 	self.Lock()
 	self.flushCommitLogsNoLock()
-	self.appender.Sync()
-	self.appender.Close()
+	for _, seg := range self.segments {
+		seg.Sync()
+		seg.Close()
+	}
 	self.Unlock()
 }
 
@@ -130,64 +357,145 @@ func (self *TopicCommitLogMgr) NextID() uint64 {
 func (self *TopicCommitLogMgr) Reset(id uint64) {
 }
 
+// rollSegmentNoLock closes the current active segment to future appends and
+// opens a new one based at nextLogID/current cumulative offset.
+func (self *TopicCommitLogMgr) rollSegmentNoLock(nextLogID int64) error {
+	cur := self.activeSegment()
+	if err := cur.Sync(); err != nil {
+		return err
+	}
+	seg, err := openOrCreateSegment(self.segDir, nextLogID, cur.baseOffset+cur.size, self.indexEveryN)
+	if err != nil {
+		return err
+	}
+	self.segments = append(self.segments, seg)
+	return nil
+}
+
 func (self *TopicCommitLogMgr) TruncateToOffset(offset int64) (*CommitLogData, error) {
 	self.Lock()
 	defer self.Unlock()
 	self.flushCommitLogsNoLock()
-	err := self.appender.Truncate(offset)
+	seg, err := self.segmentForOffset(offset)
 	if err != nil {
+		if offset == 0 {
+			seg = self.segments[0]
+		} else {
+			return nil, err
+		}
+	}
+	localOffset := offset - seg.baseOffset
+	if err := seg.logFile.Truncate(localOffset); err != nil {
 		return nil, err
 	}
+	seg.size = localOffset
+	if err := seg.truncateRecordCachesTo(localOffset); err != nil {
+		return nil, err
+	}
+	// drop any segment that came after the truncation point entirely.
+	kept := self.segments[:0:0]
+	for _, s := range self.segments {
+		if s.baseOffset > offset {
+			s.Close()
+			s.removeFiles()
+			continue
+		}
+		kept = append(kept, s)
+	}
+	self.segments = kept
+
 	if offset == 0 {
 		atomic.StoreInt64(&self.pLogID, 0)
 		return nil, nil
 	}
-	b := bytes.NewBuffer(make([]byte, GetLogDataSize()))
-	n, err := self.appender.ReadAt(b.Bytes(), offset-int64(GetLogDataSize()))
+	prevOffset, err := self.prevRecordOffsetNoLock(offset)
 	if err != nil {
 		return nil, err
 	}
-	if n != GetLogDataSize() {
-		return nil, ErrCommitLogOffsetInvalid
-	}
-	var l CommitLogData
-	err = binary.Read(b, binary.BigEndian, &l)
+	l, err := self.getCommitLogFromOffsetNoLock(prevOffset)
 	if err != nil {
 		return nil, err
 	}
-
 	atomic.StoreInt64(&self.pLogID, l.LogID)
-	return &l, nil
+	return l, nil
 }
 
-func (self *TopicCommitLogMgr) getCommitLogFromOffsetNoLock(offset int64) (*CommitLogData, error) {
-	self.flushCommitLogsNoLock()
-	f, err := self.appender.Stat()
-	if err != nil {
-		return nil, err
+// TruncateBeforeLogID drops whole segments that end strictly before logID,
+// implementing retention by deleting complete, no-longer-needed segments
+// rather than rewriting a single growing file.
+func (self *TopicCommitLogMgr) TruncateBeforeLogID(logID int64) error {
+	self.Lock()
+	defer self.Unlock()
+	if len(self.segments) <= 1 {
+		return nil
+	}
+	kept := self.segments[:0:0]
+	for i, seg := range self.segments {
+		// never delete the last segment we have not yet rolled past, nor
+		// the segment that logID itself could still live in.
+		if i+1 < len(self.segments) && self.segments[i+1].baseID <= logID {
+			if err := seg.Close(); err != nil {
+				return err
+			}
+			if err := seg.removeFiles(); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, seg)
 	}
-	fsize := f.Size()
-	if offset == fsize {
-		return nil, ErrCommitLogEOF
+	self.segments = kept
+	return nil
+}
+
+// Verify walks every record in the commit log from the start, checking its
+// CRC32C, and reports how many records checked out (numChecked) and the
+// global offset of the first corrupt record, or -1 if none was found. It is
+// meant for offline fsck-style checking, not for the hot append/read path.
+func (self *TopicCommitLogMgr) Verify() (numChecked int64, firstBadOffset int64, err error) {
+	self.Lock()
+	defer self.Unlock()
+	self.flushCommitLogsNoLock()
+	for _, seg := range self.segments {
+		off := int64(0)
+		for off < seg.size {
+			_, n, rerr := readRecordAtSegment(seg, off)
+			if rerr != nil {
+				return numChecked, seg.baseOffset + off, rerr
+			}
+			numChecked++
+			off += n
+		}
 	}
+	return numChecked, -1, nil
+}
 
-	if offset > fsize {
-		return nil, ErrCommitLogOutofBound
+func (self *TopicCommitLogMgr) getCommitLogFromOffsetNoLock(offset int64) (*CommitLogData, error) {
+	l, _, err := self.getCommitLogAndLenFromOffsetNoLock(offset)
+	return l, err
+}
+
+// getCommitLogAndLenFromOffsetNoLock reads the record starting at the given
+// global offset and also returns its on-disk length, so callers iterating
+// forward can advance past variable-length framed records.
+func (self *TopicCommitLogMgr) getCommitLogAndLenFromOffsetNoLock(offset int64) (*CommitLogData, int64, error) {
+	self.flushCommitLogsNoLock()
+	total := self.totalSizeNoLock()
+	if offset == total {
+		return nil, 0, ErrCommitLogEOF
 	}
-	if (offset % int64(GetLogDataSize())) != 0 {
-		return nil, ErrCommitLogOffsetInvalid
+	if offset > total {
+		return nil, 0, ErrCommitLogOutofBound
 	}
-	b := bytes.NewBuffer(make([]byte, GetLogDataSize()))
-	n, err := self.appender.ReadAt(b.Bytes(), offset)
+	seg, err := self.segmentForOffset(offset)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	if n != GetLogDataSize() {
-		return nil, ErrCommitLogOffsetInvalid
+	localOffset := offset - seg.baseOffset
+	if seg.legacyFixed && (localOffset%int64(GetLogDataSize())) != 0 {
+		return nil, 0, ErrCommitLogOffsetInvalid
 	}
-	var l CommitLogData
-	err = binary.Read(b, binary.BigEndian, &l)
-	return &l, err
+	return readRecordAtSegment(seg, localOffset)
 }
 
 func (self *TopicCommitLogMgr) GetCommitLogFromOffset(offset int64) (*CommitLogData, error) {
@@ -197,38 +505,43 @@ func (self *TopicCommitLogMgr) GetCommitLogFromOffset(offset int64) (*CommitLogD
 	return ret, err
 }
 
-func (self *TopicCommitLogMgr) GetLastLogOffset() (int64, error) {
-	self.Lock()
-	defer self.Unlock()
+// GetLastLogOffset binary-searches segment file names to find the segment
+// holding pLogID, then binary-searches that segment's sparse index to
+// bound a short linear scan, instead of scanning from EOF.
+func (self *TopicCommitLogMgr) getLastLogOffsetNoLock() (int64, error) {
 	self.flushCommitLogsNoLock()
-	f, err := self.appender.Stat()
-	if err != nil {
-		return 0, err
-	}
-	fsize := f.Size()
-	if fsize == 0 {
+	total := self.totalSizeNoLock()
+	if total == 0 {
 		return 0, nil
 	}
-	num := fsize / int64(GetLogDataSize())
-	roundOffset := (num - 1) * int64(GetLogDataSize())
+	target := atomic.LoadInt64(&self.pLogID)
+	seg := self.segmentForLogID(target)
+	startLocal := seg.findStartOffset(target)
+	roundOffset := seg.baseOffset + startLocal
 	for {
-		l, err := self.getCommitLogFromOffsetNoLock(roundOffset)
+		l, n, err := self.getCommitLogAndLenFromOffsetNoLock(roundOffset)
 		if err != nil {
 			return 0, err
 		}
-		if l.LogID == atomic.LoadInt64(&self.pLogID) {
+		if l.LogID == target {
 			return roundOffset, nil
-		} else if l.LogID < atomic.LoadInt64(&self.pLogID) {
+		} else if l.LogID > target {
 			break
 		}
-		roundOffset -= int64(GetLogDataSize())
-		if roundOffset < 0 {
+		roundOffset += n
+		if roundOffset >= self.totalSizeNoLock() {
 			break
 		}
 	}
 	return 0, ErrCommitLogIDNotFound
 }
 
+func (self *TopicCommitLogMgr) GetLastLogOffset() (int64, error) {
+	self.Lock()
+	defer self.Unlock()
+	return self.getLastLogOffsetNoLock()
+}
+
 func (self *TopicCommitLogMgr) GetLastCommitLogID() int64 {
 	return atomic.LoadInt64(&self.pLogID)
 }
@@ -251,8 +564,7 @@ func (self *TopicCommitLogMgr) AppendCommitLog(l *CommitLogData, slave bool) err
 	}
 	if cap(self.committedLogs) == 0 {
 		// no buffer, write to file directly.
-		err := binary.Write(self.appender, binary.BigEndian, l)
-		if err != nil {
+		if err := self.appendOneNoLock(l); err != nil {
 			return err
 		}
 	} else {
@@ -262,14 +574,46 @@ func (self *TopicCommitLogMgr) AppendCommitLog(l *CommitLogData, slave bool) err
 		self.committedLogs = append(self.committedLogs, *l)
 	}
 	atomic.StoreInt64(&self.pLogID, l.LogID)
+	self.cond.Broadcast()
 	return nil
 }
 
+// appendOneNoLock writes a single record to the active segment, rolling
+// over to a new segment first if it would exceed MaxSegmentBytes, or if the
+// active segment is a legacy fixed-stride one (those are never appended to
+// again, to avoid mixing record formats within a segment).
+func (self *TopicCommitLogMgr) appendOneNoLock(l *CommitLogData) error {
+	active := self.activeSegment()
+	if active.legacyFixed || (active.size > 0 && active.size >= self.maxSegBytes) {
+		if err := self.rollSegmentNoLock(l.LogID); err != nil {
+			return err
+		}
+		active = self.activeSegment()
+	}
+	// make sure the in-memory record-boundary cache reflects every record
+	// already on disk before appending to it, in case this segment was
+	// loaded from disk and never scanned in this process yet.
+	if err := active.ensureRecordOffsets(); err != nil {
+		return err
+	}
+	localOffset := active.size
+	n, err := writeRecord(active.logFile, l, self.compression)
+	if err != nil {
+		return err
+	}
+	active.size += n
+	active.recordOffsets = append(active.recordOffsets, localOffset)
+	if err := active.maybeAppendIndex(l.LogID, localOffset); err != nil {
+		return err
+	}
+	return self.maybeSyncNoLock(active)
+}
+
 func (self *TopicCommitLogMgr) flushCommitLogsNoLock() {
 	// write buffered commit logs to file.
 	for _, v := range self.committedLogs {
-		err := binary.Write(self.appender, binary.BigEndian, v)
-		if err != nil {
+		vv := v
+		if err := self.appendOneNoLock(&vv); err != nil {
 			panic(err)
 		}
 	}
@@ -286,71 +630,149 @@ func (self *TopicCommitLogMgr) GetCommitLogs(startOffset int64, num int) ([]Comm
 	self.Lock()
 	defer self.Unlock()
 	self.flushCommitLogsNoLock()
-	f, err := self.appender.Stat()
-	if err != nil {
-		return nil, err
-	}
-	fsize := f.Size()
-	if startOffset == fsize {
+	total := self.totalSizeNoLock()
+	if startOffset == total {
 		return nil, nil
 	}
-	if startOffset > fsize-int64(GetLogDataSize()) {
+	if startOffset > total {
 		return nil, ErrCommitLogOutofBound
 	}
-	if (startOffset % int64(GetLogDataSize())) != 0 {
-		return nil, ErrCommitLogOffsetInvalid
-	}
-	needRead := int64(num * GetLogDataSize())
-	if startOffset+needRead > fsize {
-		needRead = fsize - startOffset
-	}
-	b := bytes.NewBuffer(make([]byte, needRead))
-	n, err := self.appender.ReadAt(b.Bytes(), startOffset)
-	if err != nil {
-		if err != io.EOF {
-			return nil, err
-		}
-	}
-	logList := make([]CommitLogData, 0, n/GetLogDataSize())
-	var l CommitLogData
-	for n > 0 {
-		err := binary.Read(b, binary.BigEndian, &l)
+	logList := make([]CommitLogData, 0, num)
+	offset := startOffset
+	for len(logList) < num && offset < total {
+		l, n, err := self.getCommitLogAndLenFromOffsetNoLock(offset)
 		if err != nil {
+			if err == ErrCommitLogEOF {
+				break
+			}
 			return nil, err
 		}
-		logList = append(logList, l)
-		n -= GetLogDataSize()
+		logList = append(logList, *l)
+		offset += n
 	}
-	return logList, err
+	return logList, nil
 }
 
 func (self *TopicCommitLogMgr) GetCommitLogsReverse(startIndex int64, num int) ([]CommitLogData, error) {
 	self.Lock()
 	defer self.Unlock()
+	self.flushCommitLogsNoLock()
 	ret := make([]CommitLogData, 0, num)
-	for i := startIndex; i < int64(len(self.committedLogs)); i++ {
-		ret = append(ret, self.committedLogs[len(self.committedLogs)-int(i)-1])
-		if len(ret) >= num {
-			return ret, nil
+	skipped := int64(0)
+	// walk backwards across segments using each segment's cached
+	// record-boundary list (built lazily on first use), spanning segment
+	// boundaries as needed since records are no longer a fixed stride.
+	// The first startIndex records from the tail are skipped rather than
+	// collected, so callers paging with successive startIndex values get
+	// successive non-overlapping pages instead of always the newest num.
+	for segIdx := len(self.segments) - 1; segIdx >= 0 && len(ret) < num; segIdx-- {
+		seg := self.segments[segIdx]
+		if err := seg.ensureRecordOffsets(); err != nil {
+			return nil, err
+		}
+		for j := len(seg.recordOffsets) - 1; j >= 0 && len(ret) < num; j-- {
+			if skipped < startIndex {
+				skipped++
+				continue
+			}
+			l, _, err := readRecordAtSegment(seg, seg.recordOffsets[j])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, *l)
 		}
 	}
-	dataSize := GetLogDataSize()
-	// TODO: read from end of commit file.
-	endOffset := 0
-	readStart := endOffset - dataSize*(num-len(ret))
-	if readStart < 0 {
-		readStart = 0
-	}
-	buf := make([]byte, endOffset-readStart)
-	// TODO: read file data to buf
-	var tmp CommitLogData
-	for i := 0; i < len(buf)-dataSize; i++ {
-		err := binary.Read(bytes.NewReader(buf[i:i+dataSize]), binary.BigEndian, &tmp)
+	return ret, nil
+}
+
+// readRecordAtSegment reads the record at localOffset within seg,
+// dispatching to the legacy fixed-stride decoder or the framed decoder
+// depending on how the segment was written.
+func readRecordAtSegment(seg *commitLogSegment, localOffset int64) (*CommitLogData, int64, error) {
+	if seg.legacyFixed {
+		b := bytes.NewBuffer(make([]byte, GetLogDataSize()))
+		n, err := seg.logFile.ReadAt(b.Bytes(), localOffset)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		if n != GetLogDataSize() {
+			return nil, 0, ErrCommitLogOffsetInvalid
 		}
-		ret = append(ret, tmp)
-		i = i + dataSize
+		var l CommitLogData
+		err = binary.Read(b, binary.BigEndian, &l)
+		return &l, int64(GetLogDataSize()), err
 	}
-	return ret, nil
+	return readRecordAt(seg.logFile, localOffset)
+}
+
+// migrateLegacyCommitLogIfNeeded detects the old single-file layout (a
+// regular file at segPath instead of a directory of segments) and rewrites
+// it as segment 0 of the new layout before InitTopicCommitLogMgr opens it.
+func migrateLegacyCommitLogIfNeeded(segPath string) error {
+	fi, err := os.Stat(segPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	tmpDir := segPath + ".migrating"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	old, err := os.Open(segPath)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	newLogPath := segmentLogPath(tmpDir, 0)
+	newLog, err := os.Create(newLogPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(newLog, old); err != nil {
+		newLog.Close()
+		return err
+	}
+	if err := newLog.Close(); err != nil {
+		return err
+	}
+	if err := buildIndexForLegacySegment(tmpDir, 0); err != nil {
+		return err
+	}
+	if err := os.Remove(segPath); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, segPath)
+}
+
+// buildIndexForLegacySegment scans a migrated segment's fixed-stride
+// records once to populate its sparse .index file.
+func buildIndexForLegacySegment(dir string, baseID int64) error {
+	seg, err := openOrCreateSegment(dir, baseID, 0, DEFAULT_SEGMENT_INDEX_INTERVAL)
+	if err != nil {
+		return err
+	}
+	defer seg.Close()
+	recSize := int64(GetLogDataSize())
+	for offset := int64(0); offset+recSize <= seg.size; offset += recSize {
+		b := bytes.NewBuffer(make([]byte, recSize))
+		if _, err := seg.logFile.ReadAt(b.Bytes(), offset); err != nil {
+			return err
+		}
+		var l CommitLogData
+		if err := binary.Read(b, binary.BigEndian, &l); err != nil {
+			return err
+		}
+		if err := seg.maybeAppendIndex(l.LogID, offset); err != nil {
+			return err
+		}
+	}
+	return seg.Sync()
 }
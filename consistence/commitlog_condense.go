@@ -0,0 +1,297 @@
+package consistence
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DEFAULT_CONDENSE_MAINTENANCE_INTERVAL is how often the background
+	// condensor checks whether the log has grown past
+	// MaxUncondensedBytes, when maintenance is enabled.
+	DEFAULT_CONDENSE_MAINTENANCE_INTERVAL = 10 * time.Minute
+	// DEFAULT_MAX_UNCONDENSED_BYTES is the default threshold above which
+	// the background condensor kicks in.
+	DEFAULT_MAX_UNCONDENSED_BYTES = 512 * 1024 * 1024
+
+	condensedBaseName = "condensed"
+)
+
+// CondenseStats reports the outcome of the most recent condensation run,
+// for metrics/monitoring.
+type CondenseStats struct {
+	RecordsBefore int64
+	RecordsAfter  int64
+	LastRunAt     time.Time
+	LastRunTook   time.Duration
+}
+
+type condensor struct {
+	mgr       *TopicCommitLogMgr
+	interval  time.Duration
+	maxBytes  int64
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+	statsLock sync.Mutex
+	stats     CondenseStats
+}
+
+// StartCondensing launches the background maintenance goroutine that
+// periodically rewrites the commit log into a condensed form once it
+// grows past maxUncondensedBytes, coalescing records whose MsgOffset
+// ranges overlap (e.g. retried batches, or ranges superseded by a later
+// checkpoint) into a single record. The later record's LogID/Epoch is kept
+// only when its range ends at or past the earlier one's; a later record
+// that ends short of the earlier range is dropped and the earlier record,
+// with its older LogID/Epoch, is kept. Call StopCondensing to shut it down.
+func (self *TopicCommitLogMgr) StartCondensing(interval time.Duration, maxUncondensedBytes int64) {
+	if interval <= 0 {
+		interval = DEFAULT_CONDENSE_MAINTENANCE_INTERVAL
+	}
+	if maxUncondensedBytes <= 0 {
+		maxUncondensedBytes = DEFAULT_MAX_UNCONDENSED_BYTES
+	}
+	c := &condensor{
+		mgr:      self,
+		interval: interval,
+		maxBytes: maxUncondensedBytes,
+		stopCh:   make(chan struct{}),
+	}
+	self.Lock()
+	self.condensor = c
+	self.Unlock()
+	c.wg.Add(1)
+	go c.loop()
+}
+
+// StopCondensing stops the background maintenance goroutine started by
+// StartCondensing, if any.
+func (self *TopicCommitLogMgr) StopCondensing() {
+	self.Lock()
+	c := self.condensor
+	self.condensor = nil
+	self.Unlock()
+	if c == nil {
+		return
+	}
+	close(c.stopCh)
+	c.wg.Wait()
+}
+
+// CondenseStats returns the outcome of the most recent condensation run of
+// the background condensor started by StartCondensing. It returns zero
+// stats when no condensor is running; a ForceCondense made while none is
+// running is not recorded.
+func (self *TopicCommitLogMgr) CondenseStats() CondenseStats {
+	self.Lock()
+	c := self.condensor
+	self.Unlock()
+	if c == nil {
+		return CondenseStats{}
+	}
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.stats
+}
+
+// ForceCondense runs a condensation pass immediately, regardless of the
+// configured MaxUncondensedBytes threshold.
+func (self *TopicCommitLogMgr) ForceCondense() error {
+	self.Lock()
+	c := self.condensor
+	self.Unlock()
+	if c == nil {
+		c = &condensor{mgr: self}
+	}
+	return c.run()
+}
+
+func (c *condensor) loop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			c.mgr.Lock()
+			total := c.mgr.totalSizeNoLock()
+			c.mgr.Unlock()
+			if total < c.maxBytes {
+				continue
+			}
+			if err := c.run(); err != nil {
+				coordLog.Infof("commit log condense for %s-%d failed: %v", c.mgr.topic, c.mgr.partition, err)
+			}
+		}
+	}
+}
+
+// run performs one condensation pass: read every record still on disk,
+// coalesce overlapping/superseded MsgOffset ranges, write the result to a
+// `.condensing` sidecar, atomically rename it to `.condensed`, then swap it
+// in for the current segments under the manager's lock.
+func (c *condensor) run() error {
+	start := time.Now()
+	mgr := c.mgr
+	// Hold the manager lock for the entire read/coalesce/write/swap: any
+	// AppendCommitLog that landed during an unlocked window here would grow
+	// or roll the active segment, and the segments-removal loop below would
+	// then delete those records out from under it while pLogID kept
+	// pointing past the (now gone) condensed log.
+	mgr.Lock()
+	defer mgr.Unlock()
+	mgr.flushCommitLogsNoLock()
+	segs := append([]*commitLogSegment(nil), mgr.segments...)
+	segDir := mgr.segDir
+	indexEveryN := mgr.indexEveryN
+
+	var before int64
+	var all []CommitLogData
+	for _, seg := range segs {
+		off := int64(0)
+		for off < seg.size {
+			l, n, err := readRecordAtSegment(seg, off)
+			if err != nil {
+				return err
+			}
+			all = append(all, *l)
+			before++
+			off += n
+		}
+	}
+	condensed := coalesceByMsgOffsetRange(all)
+
+	logPath := filepath.Join(segDir, condensedBaseName+".log.condensing")
+	idxPath := filepath.Join(segDir, condensedBaseName+".index.condensing")
+	if err := writeCondensedFiles(logPath, idxPath, condensed, indexEveryN); err != nil {
+		return err
+	}
+	finalLogPath := filepath.Join(segDir, condensedBaseName+".log.condensed")
+	finalIdxPath := filepath.Join(segDir, condensedBaseName+".index.condensed")
+	if err := os.Rename(logPath, finalLogPath); err != nil {
+		return err
+	}
+	if err := os.Rename(idxPath, finalIdxPath); err != nil {
+		return err
+	}
+
+	for _, seg := range mgr.segments {
+		seg.Close()
+		seg.removeFiles()
+	}
+	baseID := int64(0)
+	if len(condensed) > 0 {
+		baseID = condensed[0].LogID
+	}
+	if err := os.Rename(finalLogPath, segmentLogPath(segDir, baseID)); err != nil {
+		return err
+	}
+	if err := os.Rename(finalIdxPath, segmentIndexPath(segDir, baseID)); err != nil {
+		return err
+	}
+	newSeg, err := openOrCreateSegment(segDir, baseID, 0, indexEveryN)
+	if err != nil {
+		return err
+	}
+	mgr.segments = []*commitLogSegment{newSeg}
+	// coalescing can drop the record that was the log's last append (a
+	// stale retry superseded by an earlier one); pLogID must track the
+	// highest LogID actually present in the condensed log, or
+	// getLastLogOffsetNoLock would scan for a LogID that no longer exists.
+	lastLogID := int64(0)
+	if len(condensed) > 0 {
+		lastLogID = condensed[len(condensed)-1].LogID
+	}
+	atomic.StoreInt64(&mgr.pLogID, lastLogID)
+
+	c.statsLock.Lock()
+	c.stats = CondenseStats{
+		RecordsBefore: before,
+		RecordsAfter:  int64(len(condensed)),
+		LastRunAt:     start,
+		LastRunTook:   time.Since(start),
+	}
+	c.statsLock.Unlock()
+	return nil
+}
+
+// coalesceByMsgOffsetRange walks records in append order and drops any
+// record whose [MsgOffset, MsgOffset+MsgSize) range re-covers bytes already
+// claimed by the previous surviving record (a retried/overlapping batch),
+// keeping only the later of the two unless the earlier one extends further,
+// in which case the earlier one is kept. Adjacent records
+// (cur.MsgOffset == lastEnd) are normal contiguous writes and are both
+// kept: in a healthy log every record is adjacent to the last, so treating
+// adjacency as supersession would collapse the whole log into one record.
+func coalesceByMsgOffsetRange(all []CommitLogData) []CommitLogData {
+	if len(all) == 0 {
+		return nil
+	}
+	result := make([]CommitLogData, 0, len(all))
+	result = append(result, all[0])
+	for i := 1; i < len(all); i++ {
+		last := &result[len(result)-1]
+		cur := all[i]
+		lastEnd := last.MsgOffset + int64(last.MsgSize)
+		if cur.MsgOffset < lastEnd {
+			// cur's range overlaps bytes last already covers: it's a
+			// retry, not a new contiguous batch. Replace last if cur
+			// reaches at least as far as last does; otherwise cur is a
+			// stale retry that ends short of last and is dropped.
+			curEnd := cur.MsgOffset + int64(cur.MsgSize)
+			if curEnd >= lastEnd {
+				*last = cur
+			}
+			continue
+		}
+		result = append(result, cur)
+	}
+	return result
+}
+
+// writeCondensedFiles writes the condensed record set as a fresh framed
+// log plus its sparse index, mirroring how a live segment is built.
+func writeCondensedFiles(logPath, idxPath string, records []CommitLogData, indexEveryN int64) error {
+	logF, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer logF.Close()
+	idxF, err := os.OpenFile(idxPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer idxF.Close()
+
+	if indexEveryN <= 0 {
+		indexEveryN = DEFAULT_SEGMENT_INDEX_INTERVAL
+	}
+	var offset int64
+	var sinceIndex int64
+	for i, rec := range records {
+		rec := rec
+		n, err := writeRecord(logF, &rec, CompressionNone)
+		if err != nil {
+			return err
+		}
+		if i == 0 || sinceIndex >= indexEveryN {
+			e := segmentIndexEntry{LogID: rec.LogID, Offset: offset}
+			if err := binary.Write(idxF, binary.BigEndian, e); err != nil {
+				return err
+			}
+			sinceIndex = 0
+		}
+		sinceIndex++
+		offset += n
+	}
+	if err := logF.Sync(); err != nil {
+		return err
+	}
+	return idxF.Sync()
+}
@@ -0,0 +1,62 @@
+package consistence
+
+import "testing"
+
+func TestCoalesceByMsgOffsetRangeKeepsContiguousRecords(t *testing.T) {
+	// a healthy log is wall-to-wall contiguous batches: every record's
+	// MsgOffset equals the end of the previous one. None of these overlap,
+	// so all must survive.
+	all := []CommitLogData{
+		{LogID: 1, MsgOffset: 0, MsgSize: 10},
+		{LogID: 2, MsgOffset: 10, MsgSize: 10},
+		{LogID: 3, MsgOffset: 20, MsgSize: 10},
+	}
+	got := coalesceByMsgOffsetRange(all)
+	if len(got) != len(all) {
+		t.Fatalf("contiguous records should not be coalesced: got %d records, want %d", len(got), len(all))
+	}
+	for i := range all {
+		if got[i] != all[i] {
+			t.Fatalf("record %d changed: got %+v, want %+v", i, got[i], all[i])
+		}
+	}
+}
+
+func TestCoalesceByMsgOffsetRangeDropsOverlappingRetry(t *testing.T) {
+	// LogID 2 is a retry of the same byte range as LogID 1 (e.g. a resend
+	// after a timeout): it should replace LogID 1 rather than both
+	// surviving.
+	all := []CommitLogData{
+		{LogID: 1, MsgOffset: 0, MsgSize: 10},
+		{LogID: 2, MsgOffset: 0, MsgSize: 10},
+		{LogID: 3, MsgOffset: 10, MsgSize: 10},
+	}
+	got := coalesceByMsgOffsetRange(all)
+	want := []CommitLogData{
+		{LogID: 2, MsgOffset: 0, MsgSize: 10},
+		{LogID: 3, MsgOffset: 10, MsgSize: 10},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("record %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCoalesceByMsgOffsetRangeKeepsStaleRetryOut(t *testing.T) {
+	// a retry that covers less than what's already been recorded (e.g. a
+	// duplicate of an earlier sub-range) must not regress the surviving
+	// record to a smaller range.
+	all := []CommitLogData{
+		{LogID: 1, MsgOffset: 0, MsgSize: 10},
+		{LogID: 2, MsgOffset: 0, MsgSize: 5},
+	}
+	got := coalesceByMsgOffsetRange(all)
+	want := []CommitLogData{{LogID: 1, MsgOffset: 0, MsgSize: 10}}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package consistence
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrCommitLogReaderClosed = errors.New("commit log reader is closed")
+
+const defaultReaderReadAheadBytes = 4 * 1024
+
+// ReaderOptions configures a CommitLogReader returned by
+// TopicCommitLogMgr.NewReader.
+type ReaderOptions struct {
+	// Follow makes Next block until a new record is appended instead of
+	// returning ErrCommitLogEOF, so a replication tailer or CDC consumer
+	// doesn't have to poll GetLastLogOffset in a loop.
+	Follow bool
+	// MaxBatch caps how many records a single internal read-ahead fill
+	// fetches at once. Defaults to 128.
+	MaxBatch int
+	// Context, if set, unblocks a Follow-mode Next waiting for new data
+	// once it is done.
+	Context context.Context
+}
+
+// CommitLogReader iterates commit log records in order starting at a given
+// byte offset, using a small internal read-ahead buffer so a sequential
+// consumer (replication tailer, backup shipper, CDC consumer) doesn't pay a
+// disk read per record.
+type CommitLogReader struct {
+	mgr     *TopicCommitLogMgr
+	offset  int64
+	opts    ReaderOptions
+	buf     []CommitLogData
+	bufPos  int
+	closeCh chan struct{}
+}
+
+// NewReader returns a CommitLogReader starting at startOffset (as returned
+// by e.g. GetLastLogOffset). In Follow mode, Next blocks until a new
+// record is appended (woken by the sync.Cond broadcast in AppendCommitLog)
+// rather than requiring the caller to poll.
+func (self *TopicCommitLogMgr) NewReader(startOffset int64, opts ReaderOptions) (*CommitLogReader, error) {
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = 128
+	}
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	r := &CommitLogReader{
+		mgr:     self,
+		offset:  startOffset,
+		opts:    opts,
+		closeCh: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-opts.Context.Done():
+		case <-r.closeCh:
+		}
+		// wake any blocked Next so it notices the context was cancelled
+		// or the reader was closed, instead of waiting forever.
+		self.Lock()
+		self.cond.Broadcast()
+		self.Unlock()
+	}()
+	return r, nil
+}
+
+// seekOffsetForLogIDNoLock finds the cumulative byte offset of the first
+// record with LogID >= startLogID, using the owning segment's sparse index
+// to skip the linear scan that GetLastLogOffset used to need.
+func (self *TopicCommitLogMgr) seekOffsetForLogIDNoLock(startLogID int64) (int64, error) {
+	seg := self.segmentForLogID(startLogID)
+	offset := seg.baseOffset + seg.findStartOffset(startLogID)
+	total := self.totalSizeNoLock()
+	for offset < total {
+		l, n, err := self.getCommitLogAndLenFromOffsetNoLock(offset)
+		if err != nil {
+			return 0, err
+		}
+		if l.LogID >= startLogID {
+			break
+		}
+		offset += n
+	}
+	return offset, nil
+}
+
+// Seek repositions the reader at the first record whose LogID >= logID.
+func (r *CommitLogReader) Seek(logID int64) error {
+	r.mgr.Lock()
+	defer r.mgr.Unlock()
+	offset, err := r.mgr.seekOffsetForLogIDNoLock(logID)
+	if err != nil {
+		return err
+	}
+	r.offset = offset
+	r.buf = r.buf[:0]
+	r.bufPos = 0
+	return nil
+}
+
+// fillNoLock refills the read-ahead buffer starting at r.offset, reading up
+// to opts.MaxBatch records or defaultReaderReadAheadBytes, whichever comes
+// first.
+func (r *CommitLogReader) fillNoLock() error {
+	r.buf = r.buf[:0]
+	r.bufPos = 0
+	off := r.offset
+	var read int64
+	for len(r.buf) < r.opts.MaxBatch && read < defaultReaderReadAheadBytes {
+		l, n, err := r.mgr.getCommitLogAndLenFromOffsetNoLock(off)
+		if err != nil {
+			if err == ErrCommitLogEOF {
+				break
+			}
+			return err
+		}
+		r.buf = append(r.buf, *l)
+		off += n
+		read += n
+	}
+	r.offset = off
+	return nil
+}
+
+// Next returns the next record. Once the reader has caught up with the end
+// of the log it returns ErrCommitLogEOF, unless opts.Follow is set, in
+// which case it blocks until a new record is appended, the reader is
+// closed (ErrCommitLogReaderClosed), or opts.Context is done.
+func (r *CommitLogReader) Next() (*CommitLogData, error) {
+	r.mgr.Lock()
+	defer r.mgr.Unlock()
+	for {
+		if r.bufPos < len(r.buf) {
+			rec := r.buf[r.bufPos]
+			r.bufPos++
+			return &rec, nil
+		}
+		if err := r.fillNoLock(); err != nil {
+			return nil, err
+		}
+		if len(r.buf) > 0 {
+			continue
+		}
+		if !r.opts.Follow {
+			return nil, ErrCommitLogEOF
+		}
+		select {
+		case <-r.closeCh:
+			return nil, ErrCommitLogReaderClosed
+		case <-r.opts.Context.Done():
+			return nil, r.opts.Context.Err()
+		default:
+		}
+		r.mgr.cond.Wait()
+	}
+}
+
+func (r *CommitLogReader) Close() error {
+	select {
+	case <-r.closeCh:
+	default:
+		close(r.closeCh)
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package consistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// DEFAULT_SEGMENT_MAX_BYTES is the default size at which a segment is
+	// rolled over to a new one.
+	DEFAULT_SEGMENT_MAX_BYTES = 100 * 1024 * 1024
+	// DEFAULT_SEGMENT_INDEX_INTERVAL controls how many records are appended
+	// to a segment between two consecutive sparse index entries.
+	DEFAULT_SEGMENT_INDEX_INTERVAL = 128
+
+	segmentFileSuffix      = ".log"
+	segmentIndexFileSuffix = ".index"
+	segmentNameWidth       = 20
+)
+
+// segmentIndexEntry is one sparse (logID, offset) pair stored in a
+// segment's .index file. offset is relative to the beginning of the
+// segment's .log file.
+type segmentIndexEntry struct {
+	LogID  int64
+	Offset int64
+}
+
+func segmentIndexEntrySize() int64 {
+	return int64(binary.Size(segmentIndexEntry{}))
+}
+
+// commitLogSegment is a single append-only chunk of the commit log plus its
+// sparse index. Segments are named after the logID of their first record
+// (baseID), except the very first segment, which is named 0, and are
+// immutable except for the currently active (last) one.
+type commitLogSegment struct {
+	baseID      int64
+	baseOffset  int64
+	logPath     string
+	indexPath   string
+	logFile     *os.File
+	indexFile   *os.File
+	index       []segmentIndexEntry
+	size        int64
+	sinceIndex  int64
+	indexEveryN int64
+	// legacyFixed marks a segment written before per-record framing was
+	// introduced: its records are fixed-size and unframed, and it is read
+	// in compatibility mode but never appended to again (appends roll
+	// over to a fresh framed segment first).
+	legacyFixed bool
+	// recordOffsets lazily caches every record boundary in the segment so
+	// reverse iteration doesn't need to re-scan from the start each time.
+	recordOffsets []int64
+}
+
+func segmentBaseName(baseID int64) string {
+	return fmt.Sprintf("%0*d", segmentNameWidth, baseID)
+}
+
+func segmentLogPath(dir string, baseID int64) string {
+	return filepath.Join(dir, segmentBaseName(baseID)+segmentFileSuffix)
+}
+
+func segmentIndexPath(dir string, baseID int64) string {
+	return filepath.Join(dir, segmentBaseName(baseID)+segmentIndexFileSuffix)
+}
+
+// openOrCreateSegment opens an existing segment or creates a new, empty one
+// rooted at baseOffset (the cumulative byte offset of the whole commit log
+// before this segment starts).
+func openOrCreateSegment(dir string, baseID int64, baseOffset int64, indexEveryN int64) (*commitLogSegment, error) {
+	seg := &commitLogSegment{
+		baseID:      baseID,
+		baseOffset:  baseOffset,
+		logPath:     segmentLogPath(dir, baseID),
+		indexPath:   segmentIndexPath(dir, baseID),
+		indexEveryN: indexEveryN,
+	}
+	var err error
+	seg.logFile, err = os.OpenFile(seg.logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := seg.logFile.Stat()
+	if err != nil {
+		seg.logFile.Close()
+		return nil, err
+	}
+	seg.size = st.Size()
+	seg.indexFile, err = os.OpenFile(seg.indexPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		seg.logFile.Close()
+		return nil, err
+	}
+	if err := seg.loadIndex(); err != nil {
+		seg.logFile.Close()
+		seg.indexFile.Close()
+		return nil, err
+	}
+	if seg.size > 0 {
+		var firstByte [1]byte
+		if _, err := seg.logFile.ReadAt(firstByte[:], 0); err != nil {
+			seg.logFile.Close()
+			seg.indexFile.Close()
+			return nil, err
+		}
+		seg.legacyFixed = firstByte[0] != recordMagic
+	}
+	return seg, nil
+}
+
+func (s *commitLogSegment) loadIndex() error {
+	if _, err := s.indexFile.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	entrySize := segmentIndexEntrySize()
+	buf := make([]byte, entrySize)
+	s.index = s.index[:0]
+	for {
+		n, err := io.ReadFull(s.indexFile, buf)
+		if n == 0 {
+			break
+		}
+		if n != int(entrySize) {
+			// torn write of the sparse index itself, ignore the trailing
+			// partial entry, the log file remains the source of truth.
+			break
+		}
+		var e segmentIndexEntry
+		if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &e); err != nil {
+			return err
+		}
+		s.index = append(s.index, e)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	// append position must always be at EOF regardless of the reads above.
+	if _, err := s.indexFile.Seek(0, os.SEEK_END); err != nil {
+		return err
+	}
+	return nil
+}
+
+// findStartOffset returns the largest indexed byte offset (relative to the
+// segment) whose logID is <= the requested logID, so callers only need to
+// linearly scan forward a short distance from there.
+func (s *commitLogSegment) findStartOffset(logID int64) int64 {
+	if len(s.index) == 0 {
+		return 0
+	}
+	i := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].LogID > logID
+	})
+	if i == 0 {
+		return 0
+	}
+	return s.index[i-1].Offset
+}
+
+func (s *commitLogSegment) maybeAppendIndex(logID int64, offset int64) error {
+	s.sinceIndex++
+	if s.sinceIndex < s.indexEveryN && len(s.index) > 0 {
+		return nil
+	}
+	s.sinceIndex = 0
+	e := segmentIndexEntry{LogID: logID, Offset: offset}
+	if err := binary.Write(s.indexFile, binary.BigEndian, e); err != nil {
+		return err
+	}
+	s.index = append(s.index, e)
+	return nil
+}
+
+// ensureRecordOffsets builds the segment's record-boundary cache by
+// scanning it once if it hasn't been built yet in this process (e.g. right
+// after the segment was loaded from disk). It is a no-op once populated,
+// since appendOneNoLock keeps the cache up to date incrementally.
+func (s *commitLogSegment) ensureRecordOffsets() error {
+	if len(s.recordOffsets) > 0 || s.size == 0 {
+		return nil
+	}
+	if s.legacyFixed {
+		recSize := int64(GetLogDataSize())
+		for off := int64(0); off+recSize <= s.size; off += recSize {
+			s.recordOffsets = append(s.recordOffsets, off)
+		}
+		return nil
+	}
+	off := int64(0)
+	for off < s.size {
+		_, n, err := readRecordAt(s.logFile, off)
+		if err != nil {
+			return err
+		}
+		s.recordOffsets = append(s.recordOffsets, off)
+		off += n
+	}
+	return nil
+}
+
+// recoverTornWrite scans the segment once from the start, stopping at the
+// first record that fails to decode (bad magic, short read, or checksum
+// mismatch) and truncating the file back to the last good record boundary.
+// This repairs the common crash scenario where the process died midway
+// through writing the last record's frame/trailer. It returns how many
+// bytes were discarded.
+func (s *commitLogSegment) recoverTornWrite() (int64, error) {
+	if s.legacyFixed {
+		recSize := int64(GetLogDataSize())
+		rem := s.size % recSize
+		if rem == 0 {
+			return 0, nil
+		}
+		goodSize := s.size - rem
+		if err := s.logFile.Truncate(goodSize); err != nil {
+			return 0, err
+		}
+		discarded := s.size - goodSize
+		s.size = goodSize
+		return discarded, nil
+	}
+	off := int64(0)
+	for off < s.size {
+		_, n, err := readRecordAt(s.logFile, off)
+		if err != nil {
+			break
+		}
+		off += n
+	}
+	if off >= s.size {
+		return 0, nil
+	}
+	if err := s.logFile.Truncate(off); err != nil {
+		return 0, err
+	}
+	discarded := s.size - off
+	s.size = off
+	s.recordOffsets = nil
+	if err := s.trimIndexTo(off); err != nil {
+		return discarded, err
+	}
+	return discarded, nil
+}
+
+// truncateRecordCachesTo drops cached record boundaries and sparse index
+// entries at or beyond localOffset after the segment itself has been
+// truncated there.
+func (s *commitLogSegment) truncateRecordCachesTo(localOffset int64) error {
+	i := sort.Search(len(s.recordOffsets), func(i int) bool { return s.recordOffsets[i] >= localOffset })
+	s.recordOffsets = s.recordOffsets[:i]
+	return s.trimIndexTo(localOffset)
+}
+
+// trimIndexTo drops in-memory and on-disk sparse index entries at or
+// beyond localOffset.
+func (s *commitLogSegment) trimIndexTo(localOffset int64) error {
+	j := sort.Search(len(s.index), func(j int) bool { return s.index[j].Offset >= localOffset })
+	if j < len(s.index) {
+		s.index = s.index[:j]
+		if err := s.indexFile.Truncate(int64(j) * segmentIndexEntrySize()); err != nil {
+			return err
+		}
+		if _, err := s.indexFile.Seek(0, os.SEEK_END); err != nil {
+			return err
+		}
+	}
+	s.sinceIndex = 0
+	return nil
+}
+
+func (s *commitLogSegment) Sync() error {
+	if err := s.logFile.Sync(); err != nil {
+		return err
+	}
+	return s.indexFile.Sync()
+}
+
+func (s *commitLogSegment) Close() error {
+	err1 := s.logFile.Close()
+	err2 := s.indexFile.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// removeFiles deletes the segment's log and index files from disk, used by
+// retention truncation of whole (already superseded) segments.
+func (s *commitLogSegment) removeFiles() error {
+	if err := os.Remove(s.logPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
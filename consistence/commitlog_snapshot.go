@@ -0,0 +1,117 @@
+package consistence
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// newRaftBoltStores returns the boltdb-backed log and stable stores Raft
+// uses to persist its own log and term/vote metadata under raftDir.
+func newRaftBoltStores(raftDir string) (raft.LogStore, raft.StableStore, error) {
+	store, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft-log.db"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, store, nil
+}
+
+// writeSnapshotTo tars up every segment file (.log and .index) under the
+// commit log's segment directory and writes it to w, for Raft's
+// InstallSnapshot path to ship a whole commit log to a lagging follower.
+func (self *TopicCommitLogMgr) writeSnapshotTo(w io.Writer) error {
+	self.Lock()
+	self.flushCommitLogsNoLock()
+	for _, seg := range self.segments {
+		seg.Sync()
+	}
+	segDir := self.segDir
+	self.Unlock()
+
+	tw := tar.NewWriter(w)
+	entries, err := ioutil.ReadDir(segDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if fi.IsDir() {
+			continue
+		}
+		if err := writeTarFile(tw, filepath.Join(segDir, fi.Name()), fi); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, path string, fi os.FileInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr := &tar.Header{
+		Name: fi.Name(),
+		Mode: int64(fi.Mode().Perm()),
+		Size: fi.Size(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// installSnapshotFromReader replaces the on-disk segment directory with
+// the contents of the tar stream produced by writeSnapshotTo, then reopens
+// all segments. It is used to bring a lagging follower's commit log fully
+// in sync without replaying every historical raft log entry.
+func (self *TopicCommitLogMgr) installSnapshotFromReader(r io.Reader) error {
+	self.Lock()
+	defer self.Unlock()
+	for _, seg := range self.segments {
+		seg.Close()
+	}
+	self.segments = nil
+
+	tmpDir := self.segDir + ".snapshot-install"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(filepath.Join(tmpDir, hdr.Name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(self.segDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, self.segDir); err != nil {
+		return err
+	}
+	return self.loadSegments()
+}
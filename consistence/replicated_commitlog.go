@@ -0,0 +1,205 @@
+package consistence
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var (
+	ErrReplicatedCommitLogNotLeader = errors.New("this node is not the raft leader for this topic partition")
+)
+
+// raftAppendCommand is the payload proposed through Raft for every
+// AppendCommitLog call. It is gob-encoded into the Raft log entry.
+type raftAppendCommand struct {
+	Data CommitLogData
+}
+
+// ReplicatedCommitLogMgr wraps a TopicCommitLogMgr behind a Raft FSM, so
+// that AppendCommitLog is only ever durable once a quorum of peers has
+// committed it to the Raft log, replacing the ad-hoc leader/slave epoch tracking that
+// `consistence` otherwise leaves to callers of TopicCommitLogMgr directly.
+// The leader proposes each append through Raft; every member (leader
+// included) only mutates its local TopicCommitLogMgr from the FSM's Apply,
+// so the on-disk commit log is always exactly the replicated Raft log.
+type ReplicatedCommitLogMgr struct {
+	topic     string
+	partition int
+	local     *TopicCommitLogMgr
+	raft      *raft.Raft
+	fsm       *commitLogFSM
+}
+
+// NewReplicatedCommitLogMgr opens the local TopicCommitLogMgr at basepath
+// and wraps it with a Raft node listening on raftBind, using raftDir for
+// Raft's own log/stable/snapshot stores. bootstrap should be true only for
+// the very first node that creates a brand new cluster.
+func NewReplicatedCommitLogMgr(t string, p int, basepath string, commitBufSize int,
+	localID string, raftBind string, raftDir string, bootstrap bool) (*ReplicatedCommitLogMgr, error) {
+	local, err := InitTopicCommitLogMgr(t, p, basepath, commitBufSize)
+	if err != nil {
+		return nil, err
+	}
+	fsm := &commitLogFSM{local: local}
+
+	cfg := raft.DefaultConfig()
+	cfg.LocalID = raft.ServerID(localID)
+
+	snaps, err := raft.NewFileSnapshotStore(raftDir, 2, nil)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	logStore, stableStore, err := newRaftBoltStores(raftDir)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	addr, err := raft.NewTCPTransport(raftBind, nil, 3, 10*time.Second, nil)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	r, err := raft.NewRaft(cfg, fsm, logStore, stableStore, snaps, addr)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	if bootstrap {
+		cfgFuture := raft.Configuration{
+			Servers: []raft.Server{
+				{ID: cfg.LocalID, Address: addr.LocalAddr()},
+			},
+		}
+		if err := r.BootstrapCluster(cfgFuture).Error(); err != nil {
+			coordLog.Infof("raft bootstrap for %s-%d error (may already be bootstrapped): %v", t, p, err)
+		}
+	}
+	return &ReplicatedCommitLogMgr{
+		topic:     t,
+		partition: p,
+		local:     local,
+		raft:      r,
+		fsm:       fsm,
+	}, nil
+}
+
+// AppendCommitLog proposes l through Raft and only returns once it has
+// been committed to a quorum and applied to this node's local
+// TopicCommitLogMgr. It fails with ErrReplicatedCommitLogNotLeader on a
+// follower, mirroring how TopicCommitLogMgr.AppendCommitLog distinguishes
+// the leader/slave role today.
+func (self *ReplicatedCommitLogMgr) AppendCommitLog(l *CommitLogData, timeout time.Duration) error {
+	if self.raft.State() != raft.Leader {
+		return ErrReplicatedCommitLogNotLeader
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(raftAppendCommand{Data: *l}); err != nil {
+		return err
+	}
+	f := self.raft.Apply(buf.Bytes(), timeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok && err != nil {
+		return err
+	}
+	return nil
+}
+
+// Join adds peerID at peerAddr as a voter, called on the current leader
+// when a new coordinator replica comes up for this topic partition.
+func (self *ReplicatedCommitLogMgr) Join(peerID, peerAddr string) error {
+	return self.raft.AddVoter(raft.ServerID(peerID), raft.ServerAddress(peerAddr), 0, 0).Error()
+}
+
+// Leave removes peerID from the replication set, called when a replica is
+// permanently decommissioned.
+func (self *ReplicatedCommitLogMgr) Leave(peerID string) error {
+	return self.raft.RemoveServer(raft.ServerID(peerID), 0, 0).Error()
+}
+
+// LeaderCh reports leadership transitions for this topic partition's raft
+// group, replacing polling of the old leader/slave epoch.
+func (self *ReplicatedCommitLogMgr) LeaderCh() <-chan bool {
+	return self.raft.LeaderCh()
+}
+
+// Barrier blocks until all Raft operations proposed before this call have
+// been applied to this node's FSM, so callers can be sure a prior
+// AppendCommitLog is visible through the local TopicCommitLogMgr.
+func (self *ReplicatedCommitLogMgr) Barrier(timeout time.Duration) error {
+	return self.raft.Barrier(timeout).Error()
+}
+
+// TruncateToOffset triggers a Raft snapshot after truncating the local
+// log, so the compaction is also what gets shipped to any follower that
+// needs a full InstallSnapshot instead of replaying the raft log from
+// scratch.
+func (self *ReplicatedCommitLogMgr) TruncateToOffset(offset int64) (*CommitLogData, error) {
+	l, err := self.local.TruncateToOffset(offset)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.raft.Snapshot().Error(); err != nil {
+		coordLog.Infof("raft snapshot after truncate for %s-%d error: %v", self.topic, self.partition, err)
+	}
+	return l, nil
+}
+
+func (self *ReplicatedCommitLogMgr) Close() {
+	self.raft.Shutdown()
+	self.local.Close()
+}
+
+// commitLogFSM implements raft.FSM on top of a TopicCommitLogMgr: Apply
+// replays a proposed append locally, and Snapshot/Restore ship or receive
+// the whole commit log directory so a lagging follower can catch up
+// without replaying every historical raft log entry.
+type commitLogFSM struct {
+	local *TopicCommitLogMgr
+}
+
+func (f *commitLogFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftAppendCommand
+	if err := gob.NewDecoder(bytes.NewReader(l.Data)).Decode(&cmd); err != nil {
+		return err
+	}
+	// slave=true on every member, leader included: Apply is the only path
+	// that mutates the local log, so nLogID must advance from the applied
+	// record here or a follower promoted to leader would hand out ids at
+	// or behind pLogID and AppendCommitLog would fail ErrCommitLogWrongID.
+	return f.local.AppendCommitLog(&cmd.Data, true)
+}
+
+func (f *commitLogFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return &commitLogSnapshot{local: f.local}, nil
+}
+
+func (f *commitLogFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	return f.local.installSnapshotFromReader(rc)
+}
+
+// commitLogSnapshot streams the whole local commit log segment directory
+// to a raft.SnapshotSink, which is how a lagging follower is brought
+// up to date instead of replaying every historical raft log entry.
+type commitLogSnapshot struct {
+	local *TopicCommitLogMgr
+}
+
+func (s *commitLogSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := s.local.writeSnapshotTo(sink)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *commitLogSnapshot) Release() {}